@@ -218,26 +218,28 @@ type MemoryBuffer struct {
 	mutex sync.Mutex
 }
 
-// XXX go through an accessor that returns a reference so that
-// we are sure we are accessing/modifying the same mutex
-func (mb MemoryBuffer) locker() *sync.Mutex {
+// locker must have a pointer receiver: MemoryBuffer is embedded by
+// value in Source, and a value receiver here would hand back the
+// address of a throwaway copy of mb on every call, so two calls from
+// the same Source would never agree on which mutex to lock.
+func (mb *MemoryBuffer) locker() *sync.Mutex {
 	return &mb.mutex
 }
 
-func (mb MemoryBuffer) Size() int {
+func (mb *MemoryBuffer) Size() int {
 	l := mb.locker()
 	l.Lock()
 	defer l.Unlock()
 
-	return int(len(mb.lines))
+	return len(mb.lines)
 }
 
-func (mb MemoryBuffer) LineAt(n int) (Line, error) {
+func (mb *MemoryBuffer) LineAt(n int) (Line, error) {
 	l := mb.locker()
 	l.Lock()
 	defer l.Unlock()
 
-	if s := mb.Size(); s <= 0 || n >= s {
+	if n < 0 || n >= len(mb.lines) {
 		return nil, errors.New("empty buffer")
 	}
 
@@ -250,26 +252,89 @@ type Source struct {
 	MemoryBuffer
 
 	in        io.Reader
+	stream    LogStream
+	multi     *multiIngest
+	spill     *RawLineBufferWithSpill
 	enableSep bool
 	ready     chan struct{}
+	readyOnce sync.Once
 	setupOnce sync.Once
+
+	// appended is signaled (non-blocking, so it never piles up) every
+	// time a line is appended, so Start wakes up promptly instead of
+	// polling. closed is closed once the input is known to have no more
+	// lines coming (EOF, a stream closing for good, or ctx being done).
+	appended  chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newEmptySource returns a Source with all the channel/once plumbing
+// every constructor needs initialized, and nothing else filled in.
+func newEmptySource() Source {
+	return Source{
+		ready:         make(chan struct{}),
+		appended:      make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+		OutputChannel: pipeline.OutputChannel(make(chan interface{})),
+	}
 }
 
 // Creates a new Source. Does not start processing the input until you
 // call Setup()
 func NewSource(in io.Reader, enableSep bool) *Source {
-	return &Source{
-		in:            in, // Note that this may be closed, so do not rely on it
-		enableSep:     enableSep,
-		ready:         make(chan struct{}),
-		setupOnce:     sync.Once{},
-		OutputChannel: pipeline.OutputChannel(make(chan interface{})),
+	s := newEmptySource()
+	s.in = in // Note that this may be closed, so do not rely on it
+	s.enableSep = enableSep
+	return &s
+}
+
+// NewFollowSource creates a Source that is fed by a LogStream instead
+// of a one-shot io.Reader, for "--follow file:...", "--follow fifo:..."
+// and "--follow unix:..." style inputs that keep producing lines past
+// their first EOF.
+func NewFollowSource(stream LogStream, enableSep bool) *Source {
+	s := newEmptySource()
+	s.stream = stream
+	s.enableSep = enableSep
+	return &s
+}
+
+// NewSpillSource creates a Source like NewSource, but for "--spill"
+// style usage: once more than memWatermark lines have accumulated, the
+// oldest ones are paged out to a chunked spill file under dir instead of
+// growing MemoryBuffer.lines without bound, so peco can be used as an
+// interactive filter over inputs much bigger than available RAM.
+// Passing "" for dir lets the spill store pick its own temp directory,
+// removed again on Close. Callers must call Close once the Source is
+// no longer needed, to clean up the backing spill file.
+func NewSpillSource(in io.Reader, enableSep bool, dir string, memWatermark int) (*Source, error) {
+	store, err := NewRawLineBufferWithSpill(dir, memWatermark)
+	if err != nil {
+		return nil, err
 	}
+	store.SetEnableSep(enableSep)
+
+	s := newEmptySource()
+	s.in = in // Note that this may be closed, so do not rely on it
+	s.enableSep = enableSep
+	s.spill = store
+	return &s, nil
 }
 
 // Setup reads from the input os.File.
 func (s *Source) Setup(state *Peco) {
 	s.setupOnce.Do(func() {
+		if s.stream != nil {
+			s.setupFollow(state)
+			return
+		}
+
+		if s.multi != nil {
+			s.setupMulti(state)
+			return
+		}
+
 		l := s.locker()
 		l.Lock()
 		defer l.Unlock()
@@ -316,40 +381,216 @@ func (s *Source) Setup(state *Peco) {
 			}
 		}()
 
-		// This sync.Once var is used to receive the notification
-		// that there was at least 1 line read from the source
-		var notify sync.Once
-		notifycb := func() {
-			// close the ready channel so others can be notified
-			// that there's at least 1 line in the buffer
-			close(s.ready)
-		}
 		scanner := bufio.NewScanner(s.in)
 		for scanner.Scan() {
 			txt := scanner.Text()
-			s.lines = append(s.lines, NewRawLine(txt, s.enableSep))
-			notify.Do(notifycb)
+			// The lock is already held for this whole loop (see
+			// above), so append directly rather than through
+			// appendLine, which would try to take it again.
+			s.appendLineLocked(NewRawLine(txt, s.enableSep))
+			s.notifyReady()
+			s.signalAppended()
 
 			go func() {
 				defer func() { recover() }()
 				refresh <- struct{}{}
 			}()
 		}
+		s.closeInput()
 		trace("Read all from source")
 	})
 }
 
-// Start starts
+// setupFollow wires up a LogStream-backed Source: it starts the
+// stream, appends every line it produces to MemoryBuffer.lines as it
+// arrives, and re-fires the UI's refresh ticker so tailed input shows
+// up without the user having to touch a key.
+func (s *Source) setupFollow(state *Peco) {
+	if err := s.stream.Setup(state); err != nil {
+		trace("Source.setupFollow: failed to set up stream: %s", err)
+		s.notifyReady()
+		s.closeInput()
+		return
+	}
+
+	ctx := context.Background()
+	if state != nil {
+		ctx = state.Context()
+	}
+
+	refresh := make(chan struct{}, 1)
+	go refreshTicker(ctx, state, refresh)
+
+	s.stream.Start(ctx)
+
+	go func() {
+		select {
+		case <-s.stream.Ready():
+			s.notifyReady()
+		case <-ctx.Done():
+		}
+	}()
+
+	go func() {
+		defer trace("Source.setupFollow: stream closed")
+		defer s.closeInput()
+		for l := range s.stream.Lines() {
+			s.appendLine(l)
+
+			select {
+			case refresh <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// setupMulti pumps every reader registered with a NewMultiSource
+// Source (and any added later via AddSource) into MemoryBuffer.lines
+// in arrival order, and only closes s.ready's counterpart - the
+// pipeline end mark fired from Start - once every reader has reached
+// EOF or ctx is canceled. Lines from the readers run starts with
+// re-fire the UI's refresh ticker the same way setupFollow does; lines
+// from a reader passed to AddSource after run has started go through
+// appendLine directly and do not re-fire it.
+func (s *Source) setupMulti(state *Peco) {
+	ctx := context.Background()
+	if state != nil {
+		ctx = state.Context()
+	}
+
+	refresh := make(chan struct{}, 1)
+	go refreshTicker(ctx, state, refresh)
+
+	onLine := func(l Line) {
+		s.appendLine(l)
+
+		select {
+		case refresh <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		defer s.closeInput()
+		if err := s.multi.run(ctx, onLine); err != nil {
+			trace("Source.setupMulti: a source reader failed: %s", err)
+		}
+		trace("Source.setupMulti: all sources reached EOF")
+	}()
+}
+
+// refreshTicker polls refresh roughly every 100ms and asks the UI to
+// redraw when something has arrived since the last tick. It's shared
+// by setupFollow and setupMulti, the two Source flavors that can keep
+// receiving lines well after Setup returns and so need to nudge the
+// UI on their own instead of waiting for the next key event.
+func refreshTicker(ctx context.Context, state *Peco, refresh chan struct{}) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			select {
+			case <-refresh:
+				if state != nil && !state.ExecQuery() {
+					state.Hub().SendDraw(false)
+				}
+			default:
+			}
+		}
+	}
+}
+
+// notifyReady closes s.ready exactly once, signalling that at least
+// one line has made it into the buffer.
+func (s *Source) notifyReady() {
+	s.readyOnce.Do(func() { close(s.ready) })
+}
+
+// appendLineLocked stores l in the backing MemoryBuffer, or - for a
+// Source built with NewSpillSource - hands it to the spill store
+// instead so the resident line count stays bounded. The caller must
+// hold s.locker().
+func (s *Source) appendLineLocked(l Line) {
+	if s.spill != nil {
+		if _, err := s.spill.Append(l); err != nil {
+			trace("Source.appendLineLocked: failed to spill line: %s", err)
+		}
+		return
+	}
+	s.lines = append(s.lines, l)
+}
+
+// appendLine is appendLineLocked plus the locking, readiness and
+// wakeup a caller that isn't already holding the lock needs.
+func (s *Source) appendLine(l Line) {
+	lk := s.locker()
+	lk.Lock()
+	s.appendLineLocked(l)
+	lk.Unlock()
+
+	s.notifyReady()
+	s.signalAppended()
+}
+
+// signalAppended wakes Start up to forward whatever appendLine just
+// added. The send is non-blocking and the channel is buffered by 1, so
+// a burst of appends collapses into a single wakeup instead of piling
+// up sends nobody is there to receive yet.
+func (s *Source) signalAppended() {
+	select {
+	case s.appended <- struct{}{}:
+	default:
+	}
+}
+
+// closeInput marks that no further lines will arrive - the backing
+// io.Reader hit EOF or a LogStream closed its channel for good - so
+// Start can emit the pipeline end mark once it has drained whatever is
+// already buffered.
+func (s *Source) closeInput() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+// Start streams whatever has already arrived, then waits on
+// s.appended/s.closed for more: unlike a fixed slice, a follow Source
+// keeps growing after Start is first called, so the end mark can only
+// be sent once s.closed has fired and every line appended before it
+// closed has been forwarded.
 func (s *Source) Start(ctx context.Context) {
 	go func() {
 		defer s.OutputChannel.SendEndMark("end of input")
 
-		for i := 0; i < len(s.lines); i++ {
+		i := 0
+		for {
+			for i < s.Size() {
+				l, err := s.LineAt(i)
+				if err != nil {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case s.OutputChannel <- l:
+					i++
+				}
+			}
+
 			select {
 			case <-ctx.Done():
 				return
-			case s.OutputChannel <- s.lines[i]:
-				// no op
+			case <-s.closed:
+				if i >= s.Size() {
+					return
+				}
+				// a line slipped in right as the input closed; loop
+				// around and drain it before sending the end mark.
+			case <-s.appended:
+				// loop around and pick up whatever just arrived
 			}
 		}
 	}()
@@ -360,3 +601,39 @@ func (s *Source) Start(ctx context.Context) {
 func (s *Source) Ready() <-chan struct{} {
 	return s.ready
 }
+
+// Size shadows the embedded MemoryBuffer.Size: a Source built with
+// NewSpillSource keeps its lines in s.spill instead of
+// MemoryBuffer.lines, so it must report the spill store's count
+// instead of the (permanently empty) embedded slice's.
+func (s *Source) Size() int {
+	if s.spill != nil {
+		l := s.locker()
+		l.Lock()
+		defer l.Unlock()
+		return s.spill.Size()
+	}
+	return s.MemoryBuffer.Size()
+}
+
+// LineAt shadows the embedded MemoryBuffer.LineAt for the same reason
+// as Size: it must fetch from s.spill, which transparently re-reads
+// lines that have already been paged out to disk.
+func (s *Source) LineAt(i int) (Line, error) {
+	if s.spill != nil {
+		l := s.locker()
+		l.Lock()
+		defer l.Unlock()
+		return s.spill.LineAt(i)
+	}
+	return s.MemoryBuffer.LineAt(i)
+}
+
+// Close releases the spill file backing a Source created with
+// NewSpillSource. It is a no-op for every other constructor.
+func (s *Source) Close() error {
+	if s.spill != nil {
+		return s.spill.Close()
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package peco
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/pkg/errors"
+)
+
+// NamedReader pairs an io.Reader with the name it should be tagged
+// with when its lines are merged into a Source by NewMultiSource or
+// AddSource.
+type NamedReader struct {
+	Name string
+	R    io.Reader
+}
+
+// OriginTagger is implemented by Lines that know which input source
+// they came from. It is deliberately not part of the Line interface
+// itself, so existing single-source callers keep working unchanged;
+// the matcher/formatter should type-assert for it when they want to
+// support "@name query" filtering or an origin column.
+type OriginTagger interface {
+	Origin() string
+}
+
+// taggedLine wraps a Line with the name of the source it was read
+// from. It satisfies the Line interface by embedding it, and adds
+// Origin() on top for callers that care.
+type taggedLine struct {
+	Line
+	origin string
+}
+
+func (tl taggedLine) Origin() string {
+	return tl.origin
+}
+
+// NewMultiSource builds a Source that merges lines from N named
+// inputs, in the order they arrive, tagging each with its source
+// name. Unlike NewSource, this Source can keep accepting new inputs
+// via AddSource even after Setup has started.
+func NewMultiSource(inputs []NamedReader, enableSep bool) *Source {
+	s := newEmptySource()
+	s.enableSep = enableSep
+	s.multi = newMultiIngest(enableSep)
+	s.multi.pending = append(s.multi.pending, inputs...)
+	return &s
+}
+
+// AddSource registers another named reader with a Source created via
+// NewMultiSource, even after Setup has already started pumping the
+// initial set of inputs. It returns an error for a Source that was
+// not created with NewMultiSource.
+func (s *Source) AddSource(ctx context.Context, name string, r io.Reader) error {
+	if s.multi == nil {
+		return errors.New("AddSource requires a Source created via NewMultiSource")
+	}
+	return s.multi.addLive(ctx, name, r, s.appendLine)
+}
+
+// multiIngest fans multiple named readers into a single Source,
+// running one goroutine per input, and only considers the merge
+// complete once every reader - including ones added later via
+// AddSource - has hit EOF, or ctx is canceled.
+//
+// This deliberately does not hand the bookkeeping to an
+// errgroup/sync.WaitGroup: AddSource can call spawnLocked at any time,
+// including the instant the last in-flight reader finishes and active
+// drops to zero, and the stdlib WaitGroup docs call that exact "Add
+// racing a Wait that's about to return" pattern unsafe. Guarding active
+// and idle with mi.mu instead means every transition is fully
+// serialized, so run() can never miss a reader added mid-wait.
+type multiIngest struct {
+	enableSep bool
+
+	mu      sync.Mutex
+	pending []NamedReader
+	active  int
+	idle    chan struct{} // closed exactly while active == 0
+	started bool
+	err     error
+}
+
+func newMultiIngest(enableSep bool) *multiIngest {
+	idle := make(chan struct{})
+	close(idle)
+	return &multiIngest{enableSep: enableSep, idle: idle}
+}
+
+// run starts a goroutine per reader registered so far (via
+// NewMultiSource or an AddSource call that raced Setup), and blocks
+// until they - and any added afterwards - have all finished.
+func (mi *multiIngest) run(ctx context.Context, onLine func(Line)) error {
+	mi.mu.Lock()
+	mi.started = true
+	pending := mi.pending
+	mi.pending = nil
+	for _, in := range pending {
+		mi.spawnLocked(ctx, in.Name, in.R, onLine)
+	}
+	mi.mu.Unlock()
+
+	for {
+		mi.mu.Lock()
+		active, idle, err := mi.active, mi.idle, mi.err
+		mi.mu.Unlock()
+
+		if active == 0 {
+			return err
+		}
+
+		select {
+		case <-idle:
+			// active may already be back above zero - a concurrent
+			// AddSource - by the time we wake up; loop around and
+			// recheck under the lock rather than trusting this fire.
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (mi *multiIngest) addLive(ctx context.Context, name string, r io.Reader, onLine func(Line)) error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+
+	if !mi.started {
+		mi.pending = append(mi.pending, NamedReader{Name: name, R: r})
+		return nil
+	}
+	mi.spawnLocked(ctx, name, r, onLine)
+	return nil
+}
+
+// spawnLocked must be called with mi.mu held.
+func (mi *multiIngest) spawnLocked(ctx context.Context, name string, r io.Reader, onLine func(Line)) {
+	if mi.active == 0 {
+		mi.idle = make(chan struct{})
+	}
+	mi.active++
+
+	go func() {
+		err := func() error {
+			rs := newReaderStream(r, mi.enableSep)
+			if err := rs.Setup(nil); err != nil {
+				return err
+			}
+			rs.Start(ctx)
+			for l := range rs.Lines() {
+				onLine(taggedLine{Line: l, origin: name})
+			}
+			return nil
+		}()
+
+		mi.mu.Lock()
+		if err != nil && mi.err == nil {
+			mi.err = err
+		}
+		mi.active--
+		if mi.active == 0 {
+			close(mi.idle)
+		}
+		mi.mu.Unlock()
+	}()
+}
@@ -0,0 +1,102 @@
+package peco
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMultiIngestOrderingAndTagging(t *testing.T) {
+	mi := newMultiIngest(false)
+	mi.pending = append(mi.pending,
+		NamedReader{Name: "a", R: strings.NewReader("a1\na2\na3\n")},
+		NamedReader{Name: "b", R: strings.NewReader("b1\nb2\n")},
+	)
+
+	var mu sync.Mutex
+	var perSource = map[string][]string{}
+
+	onLine := func(l Line) {
+		tl, ok := l.(taggedLine)
+		if !ok {
+			t.Fatalf("expected a taggedLine, got %T", l)
+		}
+		mu.Lock()
+		perSource[tl.Origin()] = append(perSource[tl.Origin()], tl.DisplayString())
+		mu.Unlock()
+	}
+
+	if err := mi.run(context.Background(), onLine); err != nil {
+		t.Fatalf("run returned unexpected error: %s", err)
+	}
+
+	wantA := []string{"a1", "a2", "a3"}
+	wantB := []string{"b1", "b2"}
+	if got := perSource["a"]; !equalStrings(got, wantA) {
+		t.Errorf("source %q: got %v, want %v (in-source order must be preserved)", "a", got, wantA)
+	}
+	if got := perSource["b"]; !equalStrings(got, wantB) {
+		t.Errorf("source %q: got %v, want %v (in-source order must be preserved)", "b", got, wantB)
+	}
+}
+
+// TestMultiIngestAddLiveDuringWait checks that a source handed to
+// addLive while run() is still waiting on the initial batch is
+// accounted for: run() must not return before the live source's line
+// has been delivered. The initial source is a pipe that is only closed
+// after addLive has returned, so addLive always lands mid-wait, and the
+// live source and the initial one then finish in either order.
+func TestMultiIngestAddLiveDuringWait(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		mi := newMultiIngest(false)
+		pr, pw := io.Pipe()
+		mi.pending = append(mi.pending, NamedReader{Name: "initial", R: pr})
+
+		var mu sync.Mutex
+		var got []string
+		onLine := func(l Line) {
+			mu.Lock()
+			got = append(got, l.(taggedLine).Origin())
+			mu.Unlock()
+		}
+
+		ctx := context.Background()
+		go func() {
+			// The write only returns once run() has started the
+			// initial reader, so addLive below always finds it waiting.
+			if _, err := pw.Write([]byte("x\n")); err != nil {
+				t.Errorf("write initial: %s", err)
+			}
+			if err := mi.addLive(ctx, "live", strings.NewReader("y\n"), onLine); err != nil {
+				t.Errorf("addLive: %s", err)
+			}
+			pw.Close()
+		}()
+
+		if err := mi.run(ctx, onLine); err != nil {
+			t.Fatalf("run returned unexpected error: %s", err)
+		}
+
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n != 2 {
+			t.Fatalf("iteration %d: run() returned with %d lines delivered, want 2 (initial + live)", i, n)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
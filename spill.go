@@ -0,0 +1,397 @@
+package peco
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Default thresholds for NewRawLineBufferWithSpill: once the
+// in-memory line count crosses spillWatermarkLines, the oldest lines
+// in the "middle" of the buffer are paged out to a chunk file on disk.
+// The watermark counts lines only; their byte size is not considered.
+const (
+	spillWatermarkLines = 100000
+	spillChunkSize      = 4096
+)
+
+// chunkIndexEntry records where one on-disk chunk lives: its byte
+// offset within the spill file, and the byte offset of each line
+// inside that chunk so LineAt can seek directly to it instead of
+// scanning the chunk from the start.
+type chunkIndexEntry struct {
+	fileOffset  int64
+	lineOffsets []int64
+	lineCount   int
+}
+
+// spillStore is the on-disk half of a spilling RawLineBuffer. Lines
+// that age out of the in-memory head/tail window are serialized here
+// in fixed-size chunks; LineAt re-reads just the chunk it needs.
+type spillStore struct {
+	mu     sync.Mutex
+	dir    string
+	ownDir bool
+	file   *os.File
+	index  []chunkIndexEntry
+
+	// writeOffset tracks the end of the file ourselves, since reads
+	// (lineAt/readLineLocked) Seek the same *os.File around and we
+	// can't rely on the OS cursor being at EOF when we next write.
+	writeOffset int64
+
+	// current (not yet flushed) chunk being accumulated in memory
+	buf []Line
+}
+
+func newSpillStore(dir string) (*spillStore, error) {
+	ownDir := false
+	if dir == "" {
+		var err error
+		dir, err = ioutil.TempDir("", "peco-spill")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create spill directory")
+		}
+		ownDir = true
+	}
+
+	f, err := ioutil.TempFile(dir, "spill-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create spill file")
+	}
+
+	return &spillStore{dir: dir, ownDir: ownDir, file: f}, nil
+}
+
+// Close removes the spill file, and - if the store created its own
+// temp directory because no dir was given - that directory too.
+func (ss *spillStore) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	name := ss.file.Name()
+	ss.file.Close()
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	if ss.ownDir {
+		return os.RemoveAll(ss.dir)
+	}
+	return nil
+}
+
+// append buffers l for the current chunk, flushing a full chunk to
+// disk once it reaches spillChunkSize lines.
+func (ss *spillStore) append(l Line) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.buf = append(ss.buf, l)
+	if len(ss.buf) >= spillChunkSize {
+		return ss.flushLocked()
+	}
+	return nil
+}
+
+// flush forces any partially-filled chunk out to disk; Replay uses
+// this to make sure nothing is left stranded in memory.
+func (ss *spillStore) flush() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.flushLocked()
+}
+
+func (ss *spillStore) flushLocked() error {
+	if len(ss.buf) == 0 {
+		return nil
+	}
+
+	// lineAt/readLineLocked Seek this same *os.File around to satisfy
+	// LineAt calls, so we can't trust the OS cursor to be at EOF here;
+	// reposition it ourselves before writing.
+	if _, err := ss.file.Seek(ss.writeOffset, io.SeekStart); err != nil {
+		return errors.Wrap(err, "failed to seek spill file to EOF")
+	}
+
+	entry := chunkIndexEntry{fileOffset: ss.writeOffset, lineOffsets: make([]int64, 0, len(ss.buf))}
+
+	w := bufio.NewWriter(ss.file)
+	var off int64
+	for _, l := range ss.buf {
+		entry.lineOffsets = append(entry.lineOffsets, off)
+		n, err := fmt.Fprintf(w, "%d\n%s\n", len(l.DisplayString()), l.DisplayString())
+		if err != nil {
+			return errors.Wrap(err, "failed to write spill chunk")
+		}
+		off += int64(n)
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "failed to flush spill chunk")
+	}
+
+	entry.lineCount = len(ss.buf)
+	ss.index = append(ss.index, entry)
+	ss.writeOffset += off
+	ss.buf = ss.buf[:0]
+	return nil
+}
+
+// lineCount is the total number of lines currently spilled to disk
+// (flushed chunks plus whatever is still buffered in memory).
+func (ss *spillStore) lineCount() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	n := len(ss.buf)
+	for _, e := range ss.index {
+		n += e.lineCount
+	}
+	return n
+}
+
+// lineAt returns the i-th spilled line (0-indexed across the whole
+// spill store), reading only the chunk that contains it.
+func (ss *spillStore) lineAt(i int, enableSep bool) (Line, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if i < 0 {
+		return nil, ErrBufferOutOfRange
+	}
+
+	// ss.index holds the oldest spilled lines (flushed chunks, in
+	// arrival order); ss.buf holds the newest ones not yet flushed.
+	// Walk the chunks first and only fall through to buf for the
+	// remainder.
+	for _, e := range ss.index {
+		if i < e.lineCount {
+			return ss.readLineLocked(e, i, enableSep)
+		}
+		i -= e.lineCount
+	}
+	if i < len(ss.buf) {
+		return ss.buf[i], nil
+	}
+	return nil, ErrBufferOutOfRange
+}
+
+func (ss *spillStore) readLineLocked(e chunkIndexEntry, i int, enableSep bool) (Line, error) {
+	if _, err := ss.file.Seek(e.fileOffset+e.lineOffsets[i], io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "failed to seek spill file")
+	}
+	r := bufio.NewReader(ss.file)
+
+	var n int
+	if _, err := fmt.Fscanf(r, "%d\n", &n); err != nil {
+		return nil, errors.Wrap(err, "failed to read spilled line header")
+	}
+	buf := make([]byte, n+1) // +1 for the trailing newline
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, errors.Wrap(err, "failed to read spilled line body")
+	}
+	return NewRawLine(string(buf[:n]), enableSep), nil
+}
+
+// replay streams every spilled line, in order, to out, honoring
+// cancelCh the same way RawLineBuffer.Replay does for its in-memory
+// lines.
+func (ss *spillStore) replay(out chan Line, cancelCh chan struct{}, enableSep bool) {
+	n := ss.lineCount()
+	for i := 0; i < n; i++ {
+		l, err := ss.lineAt(i, enableSep)
+		if err != nil {
+			return
+		}
+		select {
+		case out <- l:
+		case <-cancelCh:
+			return
+		}
+	}
+}
+
+// RawLineBufferWithSpill behaves like RawLineBuffer, but once the
+// number of resident lines crosses memWatermark, older lines in the
+// middle of the buffer are paged out, in chunks, to a spill file under
+// dir so that peco can filter inputs much larger than available RAM. A
+// hot head (the first spillChunkSize lines, or the first memWatermark+1
+// if that is fewer) and tail (the most recently appended lines) are
+// kept resident so scrolling to either end of a huge input stays cheap.
+type RawLineBufferWithSpill struct {
+	RawLineBuffer
+
+	spill        *spillStore
+	memWatermark int
+	head         []Line
+	enableSep    bool
+}
+
+// SetEnableSep controls whether lines reloaded from disk are
+// reconstructed with NewRawLine's separator handling enabled,
+// mirroring Source.enableSep. It should be set once, before the first
+// Append.
+func (rlb *RawLineBufferWithSpill) SetEnableSep(enableSep bool) {
+	rlb.enableSep = enableSep
+}
+
+// NewRawLineBufferWithSpill creates a RawLineBuffer that spills to a
+// chunked spill file under dir once more than memWatermark lines have been
+// appended. If dir is "", a temporary directory is created and
+// removed when the buffer's underlying file is cleaned up.
+func NewRawLineBufferWithSpill(dir string, memWatermark int) (*RawLineBufferWithSpill, error) {
+	if memWatermark <= 0 {
+		memWatermark = spillWatermarkLines
+	}
+
+	store, err := newSpillStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RawLineBufferWithSpill{
+		RawLineBuffer: RawLineBuffer{
+			simplePipeline: simplePipeline{},
+			lines:          []Line{},
+		},
+		spill:        store,
+		memWatermark: memWatermark,
+	}, nil
+}
+
+// Append keeps the most recent memWatermark lines resident and pages
+// everything older out to the spill store, preserving the head of
+// the input (captured once, the first time the watermark is crossed)
+// so jumping back to the start of a huge input stays cheap.
+func (rlb *RawLineBufferWithSpill) Append(l Line) (Line, error) {
+	trace("RawLineBufferWithSpill.Append: %s", l.DisplayString())
+
+	rlb.lines = append(rlb.lines, l)
+	if len(rlb.lines) <= rlb.memWatermark {
+		return l, nil
+	}
+
+	if len(rlb.head) == 0 {
+		headLen := spillChunkSize
+		if headLen > len(rlb.lines) {
+			headLen = len(rlb.lines)
+		}
+		rlb.head = append([]Line(nil), rlb.lines[:headLen]...)
+	}
+
+	// Trim rlb.lines as each line is successfully spilled, rather than
+	// only once the whole batch succeeds: if spill.append fails
+	// partway through (e.g. ENOSPC), the lines already written to
+	// disk must not be resubmitted on a later Append, or they'd be
+	// duplicated in the spill store. This reslices rather than copies,
+	// so it's O(1) regardless of memWatermark; the dropped prefix stays
+	// in the backing array until append next outgrows it and moves only
+	// the live lines to a new one.
+	for len(rlb.lines) > rlb.memWatermark {
+		if err := rlb.spill.append(rlb.lines[0]); err != nil {
+			return nil, errors.Wrap(err, "failed to spill line to disk")
+		}
+		rlb.lines = rlb.lines[1:]
+	}
+	rlb.compactIfSlack()
+
+	return l, nil
+}
+
+// compactIfSlack re-copies rlb.lines into a right-sized backing array
+// once the spare capacity past its end exceeds memWatermark. Trimming
+// spilled lines off the front in Append does not change that spare
+// capacity, since cap and len shrink together; the trimmed prefix is
+// released when append outgrows the backing array. Copying only this occasionally,
+// rather than on every Append once the watermark is crossed, is what
+// keeps ingestion amortized O(1)/line instead of the O(N*memWatermark)
+// a copy-every-call version would cost on a multi-million-line input.
+func (rlb *RawLineBufferWithSpill) compactIfSlack() {
+	if cap(rlb.lines)-len(rlb.lines) <= rlb.memWatermark {
+		return
+	}
+	rlb.lines = append([]Line(nil), rlb.lines...)
+}
+
+// AppendLine is overridden so that Pipeliner-driven appends (via
+// acceptPipeline) go through RawLineBufferWithSpill.Append rather than
+// the embedded RawLineBuffer's non-spilling one.
+func (rlb *RawLineBufferWithSpill) AppendLine(l Line) (Line, error) {
+	return rlb.Append(l)
+}
+
+// Accept is overridden for the same reason as AppendLine: Go's
+// embedding does not give RawLineBuffer.Accept virtual dispatch, so
+// without this override pipeline-fed lines would bypass spilling.
+func (rlb *RawLineBufferWithSpill) Accept(p Pipeliner) {
+	cancelCh, incomingCh := p.Pipeline()
+	rlb.cancelCh = cancelCh
+	rlb.outputCh = make(chan Line)
+	go acceptPipeline(cancelCh, incomingCh, rlb.outputCh,
+		&pipelineCtx{rlb.Append, rlb.onEnd})
+}
+
+// LineAt returns the line at index i, transparently fetching it from
+// disk if it has been spilled out of memory.
+func (rlb *RawLineBufferWithSpill) LineAt(i int) (Line, error) {
+	spilled := rlb.spill.lineCount()
+	switch {
+	case i < 0:
+		return nil, ErrBufferOutOfRange
+	case i < len(rlb.head):
+		// hot head window: served from memory even though these
+		// lines are also held in the spill store or, until they
+		// age out, in rlb.lines
+		return rlb.head[i], nil
+	case i < spilled:
+		return rlb.spill.lineAt(i, rlb.enableSep)
+	default:
+		j := i - spilled
+		if j >= len(rlb.lines) {
+			return nil, ErrBufferOutOfRange
+		}
+		return rlb.lines[j], nil
+	}
+}
+
+// Size returns the total number of lines, resident or spilled.
+func (rlb *RawLineBufferWithSpill) Size() int {
+	return rlb.spill.lineCount() + len(rlb.lines)
+}
+
+// Replay streams every line - spilled chunks first, then whatever is
+// still resident - back out over the returned pipeline output
+// channel, honoring cancelCh without ever loading the whole input
+// into memory at once.
+func (rlb *RawLineBufferWithSpill) Replay() error {
+	if err := rlb.spill.flush(); err != nil {
+		return err
+	}
+
+	rlb.outputCh = make(chan Line)
+	go func() {
+		defer func() { recover() }() // it's okay if we fail to replay
+		defer close(rlb.outputCh)
+
+		rlb.spill.replay(rlb.outputCh, rlb.cancelCh, rlb.enableSep)
+
+		for _, l := range rlb.lines {
+			select {
+			case rlb.outputCh <- l:
+			case <-rlb.cancelCh:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close releases the temp file backing the spill store. Callers that
+// created a RawLineBufferWithSpill are responsible for calling this
+// once they are done with it.
+func (rlb *RawLineBufferWithSpill) Close() error {
+	return rlb.spill.Close()
+}
@@ -0,0 +1,99 @@
+package peco
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSpillStoreChunking(t *testing.T) {
+	ss, err := newSpillStore("")
+	if err != nil {
+		t.Fatalf("newSpillStore: %s", err)
+	}
+	defer ss.Close()
+
+	// Write enough lines to span multiple chunks plus a partial one,
+	// so both flushLocked's full-chunk path and flush's partial-chunk
+	// path get exercised.
+	total := spillChunkSize*2 + 3
+	for i := 0; i < total; i++ {
+		if err := ss.append(NewRawLine(fmt.Sprintf("line-%d", i), false)); err != nil {
+			t.Fatalf("append %d: %s", i, err)
+		}
+	}
+
+	// The first two chunks should have flushed themselves already;
+	// the remainder sits unflushed in ss.buf until flush is called.
+	if got, want := len(ss.index), 2; got != want {
+		t.Fatalf("flushed chunk count = %d, want %d", got, want)
+	}
+	if got, want := len(ss.buf), 3; got != want {
+		t.Fatalf("unflushed buf length = %d, want %d", got, want)
+	}
+	if got, want := ss.lineCount(), total; got != want {
+		t.Fatalf("lineCount = %d, want %d", got, want)
+	}
+
+	if err := ss.flush(); err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+	if got, want := len(ss.index), 3; got != want {
+		t.Fatalf("flushed chunk count after flush = %d, want %d", got, want)
+	}
+	if got, want := len(ss.buf), 0; got != want {
+		t.Fatalf("unflushed buf length after flush = %d, want %d", got, want)
+	}
+
+	// Spot-check lines on both sides of a chunk boundary, and the
+	// very last line, to make sure lineAt's walk across ss.index picks
+	// the right chunk and the right offset within it.
+	for _, i := range []int{0, spillChunkSize - 1, spillChunkSize, total - 1} {
+		l, err := ss.lineAt(i, false)
+		if err != nil {
+			t.Fatalf("lineAt(%d): %s", i, err)
+		}
+		if want := fmt.Sprintf("line-%d", i); l.DisplayString() != want {
+			t.Errorf("lineAt(%d) = %q, want %q", i, l.DisplayString(), want)
+		}
+	}
+
+	if _, err := ss.lineAt(total, false); err != ErrBufferOutOfRange {
+		t.Errorf("lineAt(%d) (out of range) err = %v, want ErrBufferOutOfRange", total, err)
+	}
+}
+
+func TestRawLineBufferWithSpillWatermark(t *testing.T) {
+	const watermark = 10
+	rlb, err := NewRawLineBufferWithSpill("", watermark)
+	if err != nil {
+		t.Fatalf("NewRawLineBufferWithSpill: %s", err)
+	}
+	defer rlb.Close()
+
+	total := watermark + 25
+	for i := 0; i < total; i++ {
+		if _, err := rlb.Append(NewRawLine(fmt.Sprintf("line-%d", i), false)); err != nil {
+			t.Fatalf("Append %d: %s", i, err)
+		}
+	}
+
+	if got, want := rlb.Size(), total; got != want {
+		t.Fatalf("Size() = %d, want %d", got, want)
+	}
+
+	// Every line, whether it ended up resident or spilled, must come
+	// back in the order it was appended.
+	for i := 0; i < total; i++ {
+		l, err := rlb.LineAt(i)
+		if err != nil {
+			t.Fatalf("LineAt(%d): %s", i, err)
+		}
+		if want := fmt.Sprintf("line-%d", i); l.DisplayString() != want {
+			t.Errorf("LineAt(%d) = %q, want %q", i, l.DisplayString(), want)
+		}
+	}
+
+	if _, err := rlb.LineAt(total); err != ErrBufferOutOfRange {
+		t.Errorf("LineAt(%d) (out of range) err = %v, want ErrBufferOutOfRange", total, err)
+	}
+}
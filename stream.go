@@ -0,0 +1,497 @@
+package peco
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pkg/errors"
+)
+
+// LogStream is implemented by anything that can feed lines into a
+// Source as they become available, as opposed to a plain io.Reader
+// which is read once to EOF. Implementations are expected to keep
+// running past their first EOF (tailing a file, accepting repeated
+// connections, ...) until ctx is canceled.
+type LogStream interface {
+	// Setup prepares the underlying resource (opening files, binding
+	// listeners, etc). It must be idempotent: calling it more than
+	// once must not open the resource twice.
+	Setup(state *Peco) error
+
+	// Start begins emitting lines on the channel returned by Lines.
+	// It must return promptly; the actual work happens in a goroutine
+	// that respects ctx.Done().
+	Start(ctx context.Context)
+
+	// Lines returns the channel new lines are delivered on.
+	Lines() chan Line
+
+	// Ready returns a channel that is closed once the first line has
+	// been read from the stream.
+	Ready() <-chan struct{}
+}
+
+// streamBase holds the plumbing that every LogStream implementation
+// needs: the outbound channel, the ready-notification, and the
+// guard against double Setup/Start calls.
+type streamBase struct {
+	out       chan Line
+	ready     chan struct{}
+	setupOnce sync.Once
+	startOnce sync.Once
+	notify    sync.Once
+	enableSep bool
+}
+
+func newStreamBase(enableSep bool) streamBase {
+	return streamBase{
+		out:       make(chan Line),
+		ready:     make(chan struct{}),
+		enableSep: enableSep,
+	}
+}
+
+func (sb *streamBase) Lines() chan Line {
+	return sb.out
+}
+
+func (sb *streamBase) Ready() <-chan struct{} {
+	return sb.ready
+}
+
+func (sb *streamBase) markReady() {
+	sb.notify.Do(func() { close(sb.ready) })
+}
+
+// scanInto runs a bufio.Scanner over r, forwarding each line to
+// sb.out and marking the stream ready on the first one. It returns
+// when the scanner hits EOF/an error or ctx is done.
+func (sb *streamBase) scanInto(ctx context.Context, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l := NewRawLine(scanner.Text(), sb.enableSep)
+		select {
+		case sb.out <- l:
+			sb.markReady()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fileStream tails a regular file, picking up appended lines and
+// reopening the file if it gets rotated or truncated out from under
+// us. It detects appends and rotation by polling on a ticker every
+// pollEvery; it does not use fsnotify.
+type fileStream struct {
+	streamBase
+	path      string
+	pollEvery time.Duration
+	file      *os.File
+	lastSize  int64
+	lastInode uint64
+}
+
+func newFileStream(path string, enableSep bool) *fileStream {
+	return &fileStream{
+		streamBase: newStreamBase(enableSep),
+		path:       path,
+		pollEvery:  500 * time.Millisecond,
+	}
+}
+
+func (fs *fileStream) Setup(_ *Peco) error {
+	var err error
+	fs.setupOnce.Do(func() {
+		err = fs.reopen()
+	})
+	return err
+}
+
+func (fs *fileStream) reopen() error {
+	f, err := os.Open(fs.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %q for tailing", fs.path)
+	}
+	if fi, serr := f.Stat(); serr == nil {
+		fs.lastInode = inodeOf(fi)
+	}
+	fs.file = f
+	return nil
+}
+
+func (fs *fileStream) rotated() bool {
+	fi, err := os.Stat(fs.path)
+	if err != nil {
+		// file went away; treat as rotated so we retry opening it
+		return true
+	}
+	return inodeOf(fi) != fs.lastInode || fi.Size() < fs.lastSize
+}
+
+func (fs *fileStream) Start(ctx context.Context) {
+	fs.startOnce.Do(func() {
+		go func() {
+			defer close(fs.out)
+
+			r := bufio.NewReader(fs.file)
+			ticker := time.NewTicker(fs.pollEvery)
+			defer ticker.Stop()
+
+			readAvailable := func() {
+				for {
+					line, err := r.ReadString('\n')
+					if len(line) > 0 {
+						txt := trimNewline(line)
+						select {
+						case fs.out <- NewRawLine(txt, fs.enableSep):
+							fs.markReady()
+						case <-ctx.Done():
+							return
+						}
+					}
+					if err != nil {
+						return
+					}
+				}
+			}
+
+			for {
+				readAvailable()
+				select {
+				case <-ctx.Done():
+					fs.file.Close()
+					return
+				case <-ticker.C:
+					if fs.rotated() {
+						fs.file.Close()
+						if err := fs.reopen(); err != nil {
+							trace("fileStream: failed to reopen %q after rotation: %s", fs.path, err)
+							continue
+						}
+						r = bufio.NewReader(fs.file)
+					}
+					if fi, err := fs.file.Stat(); err == nil {
+						fs.lastSize = fi.Size()
+					}
+				}
+			}
+		}()
+	})
+}
+
+// fifoStream reads from a named pipe, re-opening it every time the
+// writing end closes so that "peco --follow fifo:/tmp/x" survives
+// multiple producers writing to the same pipe one after another.
+type fifoStream struct {
+	streamBase
+	path string
+}
+
+func newFifoStream(path string, enableSep bool) *fifoStream {
+	return &fifoStream{
+		streamBase: newStreamBase(enableSep),
+		path:       path,
+	}
+}
+
+func (fifo *fifoStream) Setup(_ *Peco) error {
+	var err error
+	fifo.setupOnce.Do(func() {
+		if fi, serr := os.Stat(fifo.path); serr != nil {
+			err = errors.Wrapf(serr, "failed to stat fifo %q", fifo.path)
+		} else if fi.Mode()&os.ModeNamedPipe == 0 {
+			err = errors.Errorf("%q is not a named pipe", fifo.path)
+		}
+	})
+	return err
+}
+
+func (fifo *fifoStream) Start(ctx context.Context) {
+	fifo.startOnce.Do(func() {
+		go func() {
+			defer close(fifo.out)
+			for {
+				f, ok := fifo.openOrCancel(ctx)
+				if !ok {
+					return
+				}
+				fifo.scanInto(ctx, f)
+				f.Close()
+
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					// writer closed its end; loop around and wait for the next one
+				}
+			}
+		}()
+	})
+}
+
+// openOrCancel opens the fifo for reading, racing the open against
+// ctx.Done(): unlike fileStream's polling ticker or socketStream's
+// listener Close, a blocking os.OpenFile on a named pipe with no
+// writer connected yet isn't otherwise interruptible, so without this
+// a canceled fifoStream with no writer would block Start's goroutine
+// forever instead of closing fifo.out. ok is false if ctx was canceled
+// before (or instead of) a writer showing up; the open itself is left
+// to finish on its own in the background.
+func (fifo *fifoStream) openOrCancel(ctx context.Context) (f *os.File, ok bool) {
+	opened := make(chan *os.File, 1)
+	go func() {
+		f, err := os.OpenFile(fifo.path, os.O_RDONLY, os.ModeNamedPipe)
+		if err != nil {
+			trace("fifoStream: failed to open %q: %s", fifo.path, err)
+			close(opened)
+			return
+		}
+		opened <- f
+	}()
+
+	select {
+	case f, ok := <-opened:
+		return f, ok
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// socketStream accepts connections on a unix or tcp listener and
+// multiplexes lines from every connection into the same channel, so
+// several concurrent writers can all feed one peco session.
+type socketStream struct {
+	streamBase
+	network string
+	address string
+	ln      net.Listener
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func newSocketStream(network, address string, enableSep bool) *socketStream {
+	return &socketStream{
+		streamBase: newStreamBase(enableSep),
+		network:    network,
+		address:    address,
+	}
+}
+
+func (ss *socketStream) Setup(_ *Peco) error {
+	var err error
+	ss.setupOnce.Do(func() {
+		ss.ln, err = net.Listen(ss.network, ss.address)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to listen on %s:%s", ss.network, ss.address)
+		}
+	})
+	return err
+}
+
+func (ss *socketStream) addConn(conn net.Conn) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.closed {
+		return false
+	}
+	if ss.conns == nil {
+		ss.conns = make(map[net.Conn]struct{})
+	}
+	ss.conns[conn] = struct{}{}
+	return true
+}
+
+func (ss *socketStream) removeConn(conn net.Conn) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.conns, conn)
+}
+
+// closeConns closes every connection currently being scanned, so that
+// ctx.Done() unblocks scanInto goroutines that are parked in a blocking
+// read on an otherwise idle connection.
+func (ss *socketStream) closeConns() {
+	ss.mu.Lock()
+	ss.closed = true
+	conns := ss.conns
+	ss.conns = nil
+	ss.mu.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+func (ss *socketStream) Start(ctx context.Context) {
+	ss.startOnce.Do(func() {
+		go func() {
+			<-ctx.Done()
+			ss.ln.Close()
+			ss.closeConns()
+		}()
+
+		go func() {
+			defer func() {
+				ss.wg.Wait()
+				close(ss.out)
+			}()
+			for {
+				conn, err := ss.ln.Accept()
+				if err != nil {
+					return
+				}
+				if !ss.addConn(conn) {
+					conn.Close()
+					continue
+				}
+				ss.wg.Add(1)
+				go func() {
+					defer ss.wg.Done()
+					defer ss.removeConn(conn)
+					defer conn.Close()
+					ss.scanInto(ctx, conn)
+				}()
+			}
+		}()
+	})
+}
+
+// dgramStream reads one line per datagram off a connectionless
+// socket (typically "udp" or "unixgram"), e.g. for syslog-style
+// senders that write one message per packet.
+type dgramStream struct {
+	streamBase
+	network string
+	address string
+	conn    net.PacketConn
+}
+
+func newDgramStream(network, address string, enableSep bool) *dgramStream {
+	return &dgramStream{
+		streamBase: newStreamBase(enableSep),
+		network:    network,
+		address:    address,
+	}
+}
+
+func (ds *dgramStream) Setup(_ *Peco) error {
+	var err error
+	ds.setupOnce.Do(func() {
+		ds.conn, err = net.ListenPacket(ds.network, ds.address)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to listen on %s:%s", ds.network, ds.address)
+		}
+	})
+	return err
+}
+
+func (ds *dgramStream) Start(ctx context.Context) {
+	ds.startOnce.Do(func() {
+		go func() {
+			<-ctx.Done()
+			ds.conn.Close()
+		}()
+
+		go func() {
+			defer close(ds.out)
+			buf := make([]byte, 64*1024)
+			for {
+				n, _, err := ds.conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				l := NewRawLine(string(buf[:n]), ds.enableSep)
+				select {
+				case ds.out <- l:
+					ds.markReady()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	})
+}
+
+// readerStream is the LogStream wrapper around a plain io.Reader,
+// preserving the original "read to EOF once" behavior for stdin and
+// similar one-shot inputs.
+type readerStream struct {
+	streamBase
+	r io.Reader
+}
+
+func newReaderStream(r io.Reader, enableSep bool) *readerStream {
+	return &readerStream{
+		streamBase: newStreamBase(enableSep),
+		r:          r,
+	}
+}
+
+func (rs *readerStream) Setup(_ *Peco) error {
+	return nil
+}
+
+func (rs *readerStream) Start(ctx context.Context) {
+	rs.startOnce.Do(func() {
+		go func() {
+			defer close(rs.out)
+			rs.scanInto(ctx, rs.r)
+		}()
+	})
+}
+
+// NewLogStreamFromSpec builds the LogStream named by spec, which is
+// expected to be in "scheme:address" form as accepted by the
+// "--follow" flag, e.g. "file:/var/log/foo", "fifo:/tmp/x",
+// "unix:/tmp/y.sock", or "tcp:127.0.0.1:9999".
+func NewLogStreamFromSpec(spec string, enableSep bool) (LogStream, error) {
+	scheme, address, err := splitFollowSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch scheme {
+	case "file":
+		return newFileStream(address, enableSep), nil
+	case "fifo":
+		return newFifoStream(address, enableSep), nil
+	case "unix":
+		return newSocketStream("unix", address, enableSep), nil
+	case "tcp":
+		return newSocketStream("tcp", address, enableSep), nil
+	case "udp":
+		return newDgramStream("udp", address, enableSep), nil
+	case "unixgram":
+		return newDgramStream("unixgram", address, enableSep), nil
+	default:
+		return nil, errors.Errorf("unknown --follow scheme %q", scheme)
+	}
+}
+
+func splitFollowSpec(spec string) (scheme, address string, err error) {
+	for i := 0; i < len(spec); i++ {
+		if spec[i] == ':' {
+			return spec[:i], spec[i+1:], nil
+		}
+	}
+	return "", "", errors.Errorf("--follow value %q must be of the form scheme:address", spec)
+}
+
+func trimNewline(s string) string {
+	if n := len(s); n > 0 && s[n-1] == '\n' {
+		s = s[:n-1]
+		if n := len(s); n > 0 && s[n-1] == '\r' {
+			s = s[:n-1]
+		}
+	}
+	return s
+}
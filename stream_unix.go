@@ -0,0 +1,18 @@
+// +build !windows
+
+package peco
+
+import (
+	"os"
+	"syscall"
+)
+
+// inodeOf returns the inode number backing fi, which fileStream uses
+// to notice that a path now points at a different file (log rotation,
+// truncate-and-recreate, etc).
+func inodeOf(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,11 @@
+// +build windows
+
+package peco
+
+import "os"
+
+// inodeOf has no good equivalent on Windows; fileStream falls back to
+// relying on the file size shrinking to detect truncation/rotation.
+func inodeOf(fi os.FileInfo) uint64 {
+	return 0
+}